@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigForward is the on-disk representation of a single -L/-R rule,
+// loaded from the -config file instead of the command line.
+type ConfigForward struct {
+	Network      string   `json:"network" yaml:"network"`
+	Bind         string   `json:"bind" yaml:"bind"`
+	Host         string   `json:"host" yaml:"host"`
+	RPC          bool     `json:"rpc" yaml:"rpc"`
+	ResetOnClose bool     `json:"reset_on_close" yaml:"reset_on_close"`
+	Allow        []string `json:"allow" yaml:"allow"`
+	Deny         []string `json:"deny" yaml:"deny"`
+}
+
+// Config is the document loaded from -config. It is re-read in full on
+// every SIGHUP, so a rule's absence on reload means "remove it", not
+// "leave it alone".
+type Config struct {
+	LocalForwards  []ConfigForward `json:"local_forwards" yaml:"local_forwards"`
+	RemoteForwards []ConfigForward `json:"remote_forwards" yaml:"remote_forwards"`
+}
+
+// localRule is what State keeps per active -config local-forward entry,
+// so a later reload can tell whether a rule changed and, if it went
+// away, close its listener.
+type localRule struct {
+	raw ConfigForward
+	srv Listener
+}
+
+// remoteRuleGen is what State keeps per active -config remote-forward
+// entry. ctx is canceled the moment the rule it belongs to is removed
+// or changed on reload, so RemoteForward goroutines already running
+// against that rule can stop instead of serving traffic for a policy
+// that's no longer in the file.
+type remoteRuleGen struct {
+	raw    ConfigForward
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// remoteRuleContext returns the context a RemoteForward call against rf
+// should select on: rf's own per-rule generation context if rf came
+// from -config (so revoking the rule via SIGHUP cancels it), or
+// state.ctx otherwise (e.g. a plain -R flag, which only ever goes away
+// on process shutdown).
+func (state *State) remoteRuleContext(rf *FwdAddr) context.Context {
+	genKey := rf.network + ":" + rf.BindAddr().String()
+
+	state.mu.Lock()
+	gen, ok := state.remoteRuleGen[genKey]
+	state.mu.Unlock()
+
+	if !ok {
+		return state.ctx
+	}
+	return gen.ctx
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	default:
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (cf *ConfigForward) toFwdAddr() (FwdAddr, error) {
+	var fa FwdAddr
+	// unix/unixpacket rules are not supported by -config: they are
+	// rejected here instead of having the bind/host strings parsed as
+	// TCP/UDP addresses.
+	if cf.Network == "unix" || cf.Network == "unixpacket" {
+		return fa, fmt.Errorf("network %q is not supported in -config rules", cf.Network)
+	}
+	if err := fa.Set(fmt.Sprintf("%s:%s:%s", cf.Network, cf.Bind, cf.Host)); err != nil {
+		return fa, err
+	}
+	fa.rpc = cf.RPC
+	fa.resetOnClose = cf.ResetOnClose
+	for _, c := range cf.Deny {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fa, fmt.Errorf("deny %q: %w", c, err)
+		}
+		fa.deny = append(fa.deny, n)
+	}
+	for _, c := range cf.Allow {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fa, fmt.Errorf("allow %q: %w", c, err)
+		}
+		fa.allow = append(fa.allow, n)
+	}
+	return fa, nil
+}
+
+// reloadConfig re-reads state.configPath and reconciles the live rule
+// set against it: new entries open listeners via LocalForwardTCP/UDP,
+// removed entries close their listeners, and state.remoteTcpFwd/
+// remoteUdpFwd are swapped atomically under state.mu. Existing,
+// unchanged rules are left untouched so their connections keep running.
+// Every remote-forward rule also gets its own cancelable context in
+// state.remoteRuleGen; a rule that's removed or changed has that
+// context canceled here, which unblocks any RemoteForward goroutine
+// still serving it (see spliceWithCancel) instead of letting it run
+// until the connection closes on its own. Local-forward connections
+// already accepted by LocalForwardTCP/UDP are not covered by this:
+// removing a local rule only closes its listener, so it stops
+// accepting new connections while the accepted ones keep running.
+// Remote-forward rules given with -R are kept across reloads.
+func reloadConfig(state *State, s *stack.Stack, doneChannel chan bool) error {
+	cfg, err := LoadConfigFile(state.configPath)
+	if err != nil {
+		return err
+	}
+
+	state.configMu.Lock()
+	defer state.configMu.Unlock()
+
+	wantLocal := make(map[string]ConfigForward, len(cfg.LocalForwards))
+	for _, cf := range cfg.LocalForwards {
+		wantLocal[cf.Network+":"+cf.Bind] = cf
+	}
+
+	for key, rule := range state.localRules {
+		if cf, ok := wantLocal[key]; ok && reflect.DeepEqual(cf, rule.raw) {
+			continue
+		}
+		rule.srv.Close()
+		delete(state.localRules, key)
+		fmt.Printf("[-] config-reload: closed local-fwd %s\n", key)
+	}
+
+	for key, cf := range wantLocal {
+		if _, ok := state.localRules[key]; ok {
+			continue
+		}
+		fa, err := cf.toFwdAddr()
+		if err != nil {
+			fmt.Printf("[!] config-reload: bad local-fwd %s: %s\n", key, err)
+			continue
+		}
+		var srv Listener
+		switch fa.network {
+		case "tcp":
+			srv, err = LocalForwardTCP(state, s, &fa, doneChannel)
+		case "udp":
+			srv, err = LocalForwardUDP(state, s, &fa, doneChannel)
+		default:
+			err = fmt.Errorf("unsupported network %q", fa.network)
+		}
+		if err != nil {
+			fmt.Printf("[!] config-reload: failed to listen on %s: %s\n", key, err)
+			continue
+		}
+		state.localRules[key] = &localRule{raw: cf, srv: srv}
+		fmt.Printf("[+] config-reload: opened local-fwd %s\n", key)
+	}
+
+	state.mu.Lock()
+	oldGen := state.remoteRuleGen
+	state.mu.Unlock()
+
+	newTcpFwd := make(map[string]*FwdAddr)
+	newUdpFwd := make(map[string]*FwdAddr)
+	// -R flag rules are not part of the file; carry them over so a
+	// reload never drops them. A file rule on the same bind address
+	// takes precedence below.
+	for i, rf := range remoteFwd {
+		switch rf.network {
+		case "tcp":
+			newTcpFwd[rf.BindAddr().String()] = &remoteFwd[i]
+		case "udp":
+			newUdpFwd[rf.BindAddr().String()] = &remoteFwd[i]
+		}
+	}
+	newGen := make(map[string]*remoteRuleGen, len(cfg.RemoteForwards))
+	for _, cf := range cfg.RemoteForwards {
+		fa, err := cf.toFwdAddr()
+		if err != nil {
+			fmt.Printf("[!] config-reload: bad remote-fwd %s:%s: %s\n", cf.Network, cf.Bind, err)
+			continue
+		}
+
+		genKey := fa.network + ":" + fa.BindAddr().String()
+		if gen, ok := oldGen[genKey]; ok && reflect.DeepEqual(gen.raw, cf) {
+			newGen[genKey] = gen
+		} else {
+			ctx, cancel := context.WithCancel(state.ctx)
+			newGen[genKey] = &remoteRuleGen{raw: cf, ctx: ctx, cancel: cancel}
+		}
+
+		switch fa.network {
+		case "tcp":
+			newTcpFwd[fa.BindAddr().String()] = &fa
+		case "udp":
+			newUdpFwd[fa.BindAddr().String()] = &fa
+		}
+	}
+
+	for genKey, gen := range oldGen {
+		if newGen[genKey] != gen {
+			gen.cancel()
+			fmt.Printf("[-] config-reload: revoked remote-fwd %s, draining its connections\n", genKey)
+		}
+	}
+
+	state.mu.Lock()
+	state.remoteTcpFwd = newTcpFwd
+	state.remoteUdpFwd = newUdpFwd
+	state.remoteRuleGen = newGen
+	state.mu.Unlock()
+
+	fmt.Printf("[+] config-reload: applied %q (%d local, %d remote)\n",
+		state.configPath, len(state.localRules), len(state.remoteTcpFwd)+len(state.remoteUdpFwd))
+	return nil
+}
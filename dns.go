@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// gatewayZone is the synthesized name that always resolves to the host,
+// mirroring the fixed 10.0.2.2 gateway address used elsewhere.
+const gatewayZone = "gateway.internal."
+
+var (
+	dnsUpstream string
+	dnsStatic   HostMap
+)
+
+func init() {
+	flag.StringVar(&dnsUpstream, "dns-upstream", "", "comma-separated upstream DNS servers (host or host:port) used instead of /etc/resolv.conf")
+	flag.Var(&dnsStatic, "dns-static", "host=ip static DNS override, may be repeated")
+}
+
+// HostMap implements flag.Value for repeated -dns-static host=ip entries.
+type HostMap map[string]net.IP
+
+func (h *HostMap) String() string {
+	return fmt.Sprintf("%v", map[string]net.IP(*h))
+}
+
+func (h *HostMap) Set(s string) error {
+	host, ipStr, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("-dns-static wants host=ip, got %q", s)
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("-dns-static: invalid ip %q", ipStr)
+	}
+	if *h == nil {
+		*h = make(HostMap)
+	}
+	(*h)[dns.Fqdn(strings.ToLower(host))] = ip
+	return nil
+}
+
+// DNSResponder answers guest DNS queries in-process instead of letting
+// them leak onto the host's network stack. Static overrides and the
+// synthesized gateway zone are resolved locally; everything else is
+// looked up through resolver, which dials dnsUpstream when configured or
+// falls back to the host's regular /etc/resolv.conf path.
+type DNSResponder struct {
+	resolver *net.Resolver
+	static   HostMap
+	gateway  net.IP
+	upstream []string
+	next     uint32
+}
+
+func NewDNSResponder(upstreamCSV string, static HostMap, gateway net.IP) *DNSResponder {
+	d := &DNSResponder{static: static, gateway: gateway}
+	for _, s := range strings.Split(upstreamCSV, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		d.upstream = append(d.upstream, s)
+	}
+	d.resolver = &net.Resolver{PreferGo: true, Dial: d.dialUpstream}
+	return d
+}
+
+func (d *DNSResponder) dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.upstream) == 0 {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	i := atomic.AddUint32(&d.next, 1)
+	return (&net.Dialer{}).DialContext(ctx, network, d.upstream[int(i)%len(d.upstream)])
+}
+
+// Answer resolves a single-question query and returns the reply to send
+// back to the guest. Names that fail to resolve come back as NXDOMAIN
+// rather than timing out; there is no list of denied names.
+func (d *DNSResponder) Answer(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Authoritative = true
+
+	if len(query.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp
+	}
+	q := query.Question[0]
+	name := strings.ToLower(q.Name)
+
+	if ip, ok := d.static[name]; ok {
+		d.appendAddr(resp, q, ip)
+		return resp
+	}
+	if name == gatewayZone && d.gateway != nil {
+		d.appendAddr(resp, q, d.gateway)
+		return resp
+	}
+
+	switch q.Qtype {
+	case dns.TypeA:
+		d.lookupAndAppend(resp, q, "ip4")
+	case dns.TypeAAAA:
+		d.lookupAndAppend(resp, q, "ip6")
+	case dns.TypePTR:
+		d.lookupPTR(resp, q)
+	default:
+		resp.Rcode = dns.RcodeNotImplemented
+	}
+	return resp
+}
+
+func (d *DNSResponder) lookupAndAppend(resp *dns.Msg, q dns.Question, network string) {
+	host := strings.TrimSuffix(q.Name, ".")
+	ips, err := d.resolver.LookupIP(context.Background(), network, host)
+	if err != nil || len(ips) == 0 {
+		resp.Rcode = dns.RcodeNameError
+		return
+	}
+	for _, ip := range ips {
+		d.appendAddr(resp, q, ip)
+	}
+}
+
+func (d *DNSResponder) lookupPTR(resp *dns.Msg, q dns.Question) {
+	names, err := d.resolver.LookupAddr(context.Background(), ptrToIP(q.Name))
+	if err != nil || len(names) == 0 {
+		resp.Rcode = dns.RcodeNameError
+		return
+	}
+	resp.Answer = append(resp.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+		Ptr: dns.Fqdn(names[0]),
+	})
+}
+
+// ptrToIP turns "1.0.2.10.in-addr.arpa." back into a dotted IP so it can
+// be handed to net.Resolver.LookupAddr. IPv6 PTR names are passed through
+// unresolved; LookupAddr will simply fail NXDOMAIN for those.
+func ptrToIP(ptrName string) string {
+	labels := dns.SplitDomainName(ptrName)
+	if strings.HasSuffix(ptrName, "in-addr.arpa.") {
+		n := len(labels) - 2
+		parts := make([]string, n)
+		for i := 0; i < n; i++ {
+			parts[n-1-i] = labels[i]
+		}
+		return strings.Join(parts, ".")
+	}
+	return ptrName
+}
+
+func (d *DNSResponder) appendAddr(resp *dns.Msg, q dns.Question, ip net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   v4,
+		})
+		return
+	}
+	resp.Answer = append(resp.Answer, &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: ip,
+	})
+}
+
+// serveDNS reads exactly one query off conn, answers it in-process and
+// writes the reply back, then closes conn. Guest
+// resolvers retry on timeout, so one shot per connection is enough.
+func serveDNS(conn KaConn, d *DNSResponder) {
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(buf[:n]); err != nil {
+		return
+	}
+	resp := d.Answer(query)
+	out, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	conn.Write(out)
+}
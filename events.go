@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var eventSocket string
+
+func init() {
+	flag.StringVar(&eventSocket, "event-socket", "", "UNIX socket to emit one JSON line per connection lifecycle event on (disabled if empty)")
+}
+
+// ConnEvent is one line emitted on -event-socket for every connection
+// lifecycle transition, replacing the stdout [+]/[-] log scraping
+// downstream orchestrators otherwise have to do.
+type ConnEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"` // "new" or "close"
+	Proto    string    `json:"proto"`
+	Guest    string    `json:"guest"`
+	Dest     string    `json:"dest"`
+	BytesIn  uint64    `json:"bytes_in,omitempty"`
+	BytesOut uint64    `json:"bytes_out,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventClientQueue is how many unwritten lines an -event-socket client
+// is allowed to fall behind by before it gets disconnected.
+const eventClientQueue = 64
+
+// eventWriteTimeout bounds how long a single Write to an -event-socket
+// client may block, so a reader that accepts bytes but never drains
+// them can't stall its writer goroutine forever either.
+const eventWriteTimeout = 5 * time.Second
+
+// eventClient owns one -event-socket connection. Emit hands it lines
+// through ch instead of writing inline, so a slow or stuck reader only
+// ever blocks its own writeLoop goroutine, never the caller.
+type eventClient struct {
+	conn net.Conn
+	ch   chan []byte
+}
+
+func newEventClient(c net.Conn) *eventClient {
+	ec := &eventClient{conn: c, ch: make(chan []byte, eventClientQueue)}
+	go ec.writeLoop()
+	return ec
+}
+
+func (ec *eventClient) writeLoop() {
+	for line := range ec.ch {
+		ec.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := ec.conn.Write(line); err != nil {
+			break
+		}
+	}
+	ec.conn.Close()
+}
+
+// EventEmitter fans ConnEvent lines out to every client currently
+// connected to -event-socket. A nil *EventEmitter is valid and Emit is a
+// no-op on it, so callers don't need to guard every call site.
+type EventEmitter struct {
+	mu      sync.Mutex
+	clients []*eventClient
+}
+
+func NewEventEmitter(path string) (*EventEmitter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	e := &EventEmitter{}
+	go e.acceptLoop(l)
+	fmt.Printf("[+] event-socket listening on %s\n", path)
+	return e, nil
+}
+
+func (e *EventEmitter) acceptLoop(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		e.mu.Lock()
+		e.clients = append(e.clients, newEventClient(c))
+		e.mu.Unlock()
+	}
+}
+
+// Emit never blocks on a client's socket: each client has its own
+// bounded queue, and a client whose queue is already full is dropped
+// and disconnected rather than allowed to stall every other
+// connection's event under e.mu.
+func (e *EventEmitter) Emit(ev ConnEvent) {
+	if e == nil {
+		return
+	}
+	ev.Time = time.Now()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alive := e.clients[:0]
+	for _, c := range e.clients {
+		select {
+		case c.ch <- line:
+			alive = append(alive, c)
+		default:
+			// Queue full: this client is too slow, drop it.
+			close(c.ch)
+		}
+	}
+	e.clients = alive
+}
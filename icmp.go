@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	xicmp "golang.org/x/net/icmp"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// icmpIdleTimeout bounds how long a (guest-addr, icmp-id) session is
+// kept open, waiting on a host-side reply, before it's torn down.
+const icmpIdleTimeout = 30 * time.Second
+
+// icmpKey identifies one ping "session" so concurrent pings from
+// different guest processes don't collide on the same host socket.
+type icmpKey struct {
+	guest string
+	id    uint16
+}
+
+// ICMPForwarder relays ICMP echo requests from the guest to their real
+// destination using an unprivileged host-side ICMP socket
+// (SOCK_DGRAM+IPPROTO_ICMP via golang.org/x/net/icmp), and relays the
+// reply back into the guest endpoint. The same RoutingAllow/RoutingDeny
+// firewall used for TCP/UDP applies here too.
+type ICMPForwarder struct {
+	state *State
+	ep    tcpip.Endpoint
+	np    tcpip.NetworkProtocolNumber
+
+	mu       sync.Mutex
+	sessions map[icmpKey]*xicmp.PacketConn
+}
+
+// EnableICMPRouting registers ICMPv4/ICMPv6 raw endpoints on s and starts
+// forwarding echo requests seen on them to their real destinations. It's
+// called once from Main, alongside the TCP/UDP forwarder setup.
+func EnableICMPRouting(s *stack.Stack, state *State) error {
+	for _, np := range []tcpip.NetworkProtocolNumber{header.IPv4ProtocolNumber, header.IPv6ProtocolNumber} {
+		tp := icmp.ProtocolNumber4
+		if np == header.IPv6ProtocolNumber {
+			tp = icmp.ProtocolNumber6
+		}
+		var wq waiter.Queue
+		ep, err := s.NewRawEndpoint(tp, np, &wq, true /* associated */)
+		if err != nil {
+			return fmt.Errorf("creating raw ICMP endpoint for proto %d: %s", np, err)
+		}
+		f := &ICMPForwarder{
+			state:    state,
+			ep:       ep,
+			np:       np,
+			sessions: make(map[icmpKey]*xicmp.PacketConn),
+		}
+		go f.serve(&wq)
+	}
+	return nil
+}
+
+// serve reads guest-originated ICMP echo requests off the raw endpoint
+// and dispatches each to the host.
+func (f *ICMPForwarder) serve(wq *waiter.Queue) {
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.ReadableEvents)
+	defer wq.EventUnregister(&we)
+
+	for {
+		var addr tcpip.FullAddress
+		v, _, err := f.ep.Read(&addr)
+		if err == tcpip.ErrWouldBlock {
+			<-ch
+			continue
+		}
+		if err != nil {
+			return
+		}
+		f.handlePacket(buffer.View(v))
+	}
+}
+
+func (f *ICMPForwarder) handlePacket(v buffer.View) {
+	src, dst, id, req, ok := parseEchoRequest(f.np, v)
+	if !ok {
+		return
+	}
+	if IPNetContains(f.state.RoutingDeny, dst) {
+		return
+	}
+	if !IPNetContains(f.state.RoutingAllow, dst) {
+		return
+	}
+
+	// "udp4"/"udp6" asks the kernel for an unprivileged ping socket
+	// (SOCK_DGRAM+IPPROTO_ICMP) instead of a raw socket, so this needs
+	// no extra capability on the host.
+	network := "udp4"
+	if f.np == header.IPv6ProtocolNumber {
+		network = "udp6"
+	}
+
+	key := icmpKey{guest: src.String(), id: id}
+	f.mu.Lock()
+	conn, ok := f.sessions[key]
+	if !ok {
+		c, err := xicmp.ListenPacket(network, "")
+		if err != nil {
+			f.mu.Unlock()
+			fmt.Printf("[!] icmp-fwd: ListenPacket(%s): %s\n", network, err)
+			return
+		}
+		conn = c
+		f.sessions[key] = conn
+		go f.pumpReplies(key, conn)
+	}
+	f.mu.Unlock()
+
+	fmt.Printf("[+] icmp://%s id=%d echo request\n", dst, id)
+	if _, err := conn.WriteTo(req, &net.IPAddr{IP: dst}); err != nil {
+		fmt.Printf("[!] icmp-fwd: write to %s: %s\n", dst, err)
+	}
+}
+
+// pumpReplies copies echo replies from the host socket back into the
+// guest endpoint until the session idles out or the host side errors.
+func (f *ICMPForwarder) pumpReplies(key icmpKey, conn *xicmp.PacketConn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.sessions, key)
+		f.mu.Unlock()
+		conn.Close()
+		fmt.Printf("[-] icmp://%s id=%d session closed\n", key.guest, key.id)
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(icmpIdleTimeout))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, _, err := f.ep.Write(tcpip.SlicePayload(buf[:n]), tcpip.WriteOptions{}); err != nil {
+			fmt.Printf("[!] icmp-fwd: writing reply back to guest: %s\n", err)
+			return
+		}
+	}
+}
+
+// parseEchoRequest pulls the echo request body and the guest (source)
+// and destination addresses out of a raw packet read from the gVisor
+// endpoint, whose framing depends on np (the raw socket is bound
+// "associated", so the IP header itself is supplied by gVisor and
+// included in v).
+func parseEchoRequest(np tcpip.NetworkProtocolNumber, v buffer.View) (src, dst net.IP, id uint16, body []byte, ok bool) {
+	switch np {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(v)
+		if len(v) < header.IPv4MinimumSize {
+			return nil, nil, 0, nil, false
+		}
+		icmpv := header.ICMPv4(ip.Payload())
+		if icmpv.Type() != header.ICMPv4Echo {
+			return nil, nil, 0, nil, false
+		}
+		return net.IP(ip.SourceAddress()), net.IP(ip.DestinationAddress()), icmpv.Ident(), []byte(icmpv), true
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(v)
+		if len(v) < header.IPv6MinimumSize {
+			return nil, nil, 0, nil, false
+		}
+		icmpv := header.ICMPv6(ip.Payload())
+		if icmpv.Type() != header.ICMPv6EchoRequest {
+			return nil, nil, 0, nil, false
+		}
+		return net.IP(ip.SourceAddress()), net.IP(ip.DestinationAddress()), icmpv.Ident(), []byte(icmpv), true
+	}
+	return nil, nil, 0, nil, false
+}
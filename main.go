@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,12 +19,15 @@ import (
 )
 
 var (
-	debug     bool
-	debugLog  string
-	netNsPath string
-	ifName    string
-	remoteFwd FwdAddrSlice
-	localFwd  FwdAddrSlice
+	debug      bool
+	debugLog   string
+	netNsPath  string
+	ifName     string
+	remoteFwd  FwdAddrSlice
+	localFwd   FwdAddrSlice
+	configPath string
+	dnsListen  string
+	ntpEnabled bool
 )
 
 func init() {
@@ -33,6 +38,10 @@ func init() {
 	flag.StringVar(&ifName, "interface", "tun0", "interface name within netns")
 	flag.Var(&remoteFwd, "R", "Connections to remote side forwarded local")
 	flag.Var(&localFwd, "L", "Connections to local side forwarded remote")
+	flag.StringVar(&configPath, "config", "", "path to a YAML/JSON file describing local_forwards/remote_forwards; SIGHUP reloads it")
+
+	flag.StringVar(&dnsListen, "dns-listen", "10.0.2.3", "virtual address the in-process DNS (and, with -ntp, NTP) responder answers on")
+	flag.BoolVar(&ntpEnabled, "ntp", false, "also answer NTP requests sent to -dns-listen with the host's clock")
 }
 
 func main() {
@@ -44,8 +53,39 @@ type State struct {
 	RoutingDeny  []*net.IPNet
 	RoutingAllow []*net.IPNet
 
-	remoteUdpFwd map[string]*FwdAddr
-	remoteTcpFwd map[string]*FwdAddr
+	// mu guards remoteUdpFwd/remoteTcpFwd/remoteRuleGen, which are
+	// replaced wholesale on every -config reload rather than mutated in
+	// place.
+	mu            sync.Mutex
+	remoteUdpFwd  map[string]*FwdAddr
+	remoteTcpFwd  map[string]*FwdAddr
+	remoteRuleGen map[string]*remoteRuleGen
+
+	// configPath and localRules are only used when -config is set; they
+	// track which local_forwards rules from the file currently have a
+	// listener open, so a SIGHUP reload knows what to add and remove.
+	configPath string
+	configMu   sync.Mutex
+	localRules map[string]*localRule
+
+	// dns answers guest queries sent to dnsAddr in-process; ntp mirrors
+	// that for time sync when -ntp is set. Both stay disabled (dns nil,
+	// ntp false) if -dns-listen is empty or couldn't be parsed.
+	dns     *DNSResponder
+	ntp     bool
+	dnsAddr net.IP
+
+	// events is nil unless -event-socket was given; Emit is a no-op on
+	// a nil *EventEmitter.
+	events *EventEmitter
+
+	// ctx is canceled on the first SIGINT/SIGTERM so in-flight
+	// RoutingForward/RemoteForward goroutines can stop early instead of
+	// running until their connection naturally closes. wg tracks those
+	// goroutines so Main can wait for them to drain before tearing the
+	// stack down.
+	ctx context.Context
+	wg  sync.WaitGroup
 }
 
 func (s *State) IsUDPRPCPort(port int) bool {
@@ -77,6 +117,9 @@ func Main() int {
 
 	state.remoteUdpFwd = make(map[string]*FwdAddr)
 	state.remoteTcpFwd = make(map[string]*FwdAddr)
+	state.configPath = configPath
+	state.localRules = make(map[string]*localRule)
+	state.remoteRuleGen = make(map[string]*remoteRuleGen)
 	// For the list of reserved IP's see
 	// https://idea.popcount.org/2019-12-06-addressing/
 	state.RoutingDeny = append(state.RoutingDeny,
@@ -139,8 +182,23 @@ func Main() int {
 
 	StackRoutingSetup(s, 1, "2001:2::2/32")
 
+	if dnsListen != "" {
+		if ip := netParseIP(dnsListen); ip != nil {
+			state.dnsAddr = ip
+			state.ntp = ntpEnabled
+			state.dns = NewDNSResponder(dnsUpstream, dnsStatic, netParseIP("10.0.2.2"))
+			StackPrimeArp(s, 1, ip)
+		} else {
+			fmt.Fprintf(os.Stderr, "[!] -dns-listen %q is not an IP, virtual DNS/NTP disabled\n", dnsListen)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state.ctx = ctx
+
 	doneChannel := make(chan bool)
 
+	var startupListeners []Listener
 	for _, lf := range localFwd {
 		var (
 			err error
@@ -159,6 +217,7 @@ func Main() int {
 			laddr := srv.Addr()
 			fmt.Printf("[+] local-fwd Local listen %s://%s\n",
 				laddr.Network(), laddr.String())
+			startupListeners = append(startupListeners, srv)
 		}
 	}
 
@@ -173,6 +232,15 @@ func Main() int {
 		}
 	}
 
+	sighupCh := make(chan os.Signal, 4)
+	if state.configPath != "" {
+		if err := reloadConfig(&state, s, doneChannel); err != nil {
+			fmt.Fprintf(os.Stderr, "[!] Failed to load -config %q: %s\n", state.configPath, err)
+			return -1
+		}
+		signal.Notify(sighupCh, syscall.SIGHUP)
+	}
+
 	tcpHandler := TcpRoutingHandler(&state)
 	fwdTcp := tcp.NewForwarder(s, 30000, 10, tcpHandler)
 	s.SetTransportProtocolHandler(tcp.ProtocolNumber, fwdTcp.HandlePacket)
@@ -181,21 +249,57 @@ func Main() int {
 	fwdUdp := udp.NewForwarder(s, udpHandler)
 	s.SetTransportProtocolHandler(udp.ProtocolNumber, fwdUdp.HandlePacket)
 
+	if err := EnableICMPRouting(s, &state); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Failed to enable ICMP routing: %s\n", err)
+	}
+
+	ServeMetrics(metricsListen)
+
+	events, err := NewEventEmitter(eventSocket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Failed to open -event-socket %q: %s\n", eventSocket, err)
+		return -1
+	}
+	state.events = events
+
 	// [****] Finally, the mighty event loop, waiting on signals
 	pid := syscall.Getpid()
 	fmt.Fprintf(os.Stderr, "[+] #%d Started\n", pid)
 	syscall.Kill(syscall.Getppid(), syscall.SIGWINCH)
 
+	shuttingDown := false
+	drained := make(chan struct{})
+	var shutdownDeadline <-chan time.Time
+
 	for {
 		select {
-		case sig := <-sigCh:
-			signal.Reset(sig)
-			fmt.Fprintf(os.Stderr, "[-] Closing\n")
+		case <-sigCh:
+			if shuttingDown {
+				fmt.Fprintf(os.Stderr, "[-] second signal, forcing immediate exit\n")
+				return -1
+			}
+			shuttingDown = true
+			fmt.Fprintf(os.Stderr, "[-] Closing, draining connections (up to %s)\n", shutdownTimeout)
+			closeListeners(&state, startupListeners)
+			cancel()
+			shutdownDeadline = time.After(shutdownTimeout)
+			go func() {
+				state.wg.Wait()
+				close(drained)
+			}()
+		case <-sighupCh:
+			fmt.Fprintf(os.Stderr, "[+] SIGHUP: reloading %q\n", state.configPath)
+			if err := reloadConfig(&state, s, doneChannel); err != nil {
+				fmt.Fprintf(os.Stderr, "[!] config reload failed: %s\n", err)
+			}
+		case <-drained:
+			goto stop
+		case <-shutdownDeadline:
+			fmt.Fprintf(os.Stderr, "[-] shutdown-timeout elapsed, tearing down with connections still draining\n")
 			goto stop
 		}
 	}
 stop:
-	// TODO: define semantics of graceful close on signal
-	//s.Wait()
+	s.Wait()
 	return 0
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch
+// (1900-01-01) and the Unix epoch (1970-01-01).
+const ntpEpochOffset = 2208988800
+
+// serveNTP answers a single NTPv3/v4 client request with the host's
+// current time, so guests that send NTP queries to the -dns-listen
+// address don't need to reach the real network. Unrecognized or
+// truncated packets are dropped rather than answered.
+func serveNTP(conn KaConn) {
+	defer conn.Close()
+
+	req := make([]byte, 48)
+	n, err := conn.Read(req)
+	if err != nil || n < 48 {
+		return
+	}
+
+	li := byte(0)
+	vn := (req[0] >> 3) & 0x7
+	if mode := req[0] & 0x7; mode != 3 || (vn != 3 && vn != 4) {
+		return // not an NTPv3/v4 client request
+	}
+	resp := make([]byte, 48)
+	resp[0] = li<<6 | vn<<3 | 4 // mode 4: server
+	resp[1] = 1                // stratum 1: primary reference
+	resp[2] = req[2]           // echo the poll interval
+	resp[3] = 0xfa             // precision: ~2^-6s
+
+	now := time.Now()
+	ntpNow := toNTPTime(now)
+	binary.BigEndian.PutUint64(resp[16:24], ntpNow) // reference timestamp
+	copy(resp[24:32], req[40:48])                   // originate = client's transmit
+	binary.BigEndian.PutUint64(resp[32:40], ntpNow)  // receive timestamp
+	binary.BigEndian.PutUint64(resp[40:48], toNTPTime(time.Now()))
+
+	conn.Write(resp)
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()+ntpEpochOffset) << 32
+	frac := uint64(t.Nanosecond()) * (1 << 32) / 1e9
+	return secs | frac
+}
@@ -19,20 +19,37 @@ func UdpRoutingHandler(state *State) func(*udp.ForwarderRequest) {
 			Port: int(id.LocalPort),
 		}
 
+		state.mu.Lock()
 		rf, ok := state.remoteUdpFwd[loc.String()]
-		if ok == false && IPNetContains(state.RoutingDeny, loc.IP) {
-			// Firewall deny
-			return
-		}
-		if ok == false && IPNetContains(state.RoutingAllow, loc.IP) == false {
-			// Firewall !allow
-			return
+		state.mu.Unlock()
+
+		// isVirtualQuery is only true for the exact ports the virtual
+		// gateway address actually answers on, and only when that
+		// responder is enabled. Every other port sent to -dns-listen
+		// (which defaults to 10.0.2.3, inside the always-deny
+		// 10.0.0.0/8 range) still has to clear the normal firewall
+		// check below like any other destination.
+		isVirtualQuery := state.dnsAddr != nil && loc.IP.Equal(state.dnsAddr) &&
+			((loc.Port == 53 && state.dns != nil) || (loc.Port == 123 && state.ntp))
+
+		if !isVirtualQuery {
+			if ok == false && IPNetContains(state.RoutingDeny, loc.IP) {
+				// Firewall deny
+				metricFirewallDenied.WithLabelValues("udp").Inc()
+				return
+			}
+			if ok == false && IPNetContains(state.RoutingAllow, loc.IP) == false {
+				// Firewall !allow
+				metricFirewallDenied.WithLabelValues("udp").Inc()
+				return
+			}
 		}
 
 		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
 			fmt.Printf("r.CreateEndpoint() = %v\n", err)
+			metricEndpointErrors.WithLabelValues("udp").Inc()
 			return
 		}
 
@@ -42,11 +59,21 @@ func UdpRoutingHandler(state *State) func(*udp.ForwarderRequest) {
 			conn.closeOnWrite = true
 		}
 
+		if isVirtualQuery && loc.Port == 53 {
+			go serveDNS(conn, state.dns)
+			return
+		}
+		if isVirtualQuery && loc.Port == 123 {
+			go serveNTP(conn)
+			return
+		}
+
+		state.wg.Add(1)
 		go func() {
 			if rf != nil {
-				RemoteForward(conn, rf)
+				RemoteForward(state, conn, rf)
 			} else {
-				RoutingForward(conn, loc)
+				RoutingForward(state, conn, loc)
 			}
 		}()
 	}
@@ -61,14 +88,18 @@ func TcpRoutingHandler(state *State) func(*tcp.ForwarderRequest) {
 			Port: int(id.LocalPort),
 		}
 
+		state.mu.Lock()
 		rf, ok := state.remoteTcpFwd[loc.String()]
+		state.mu.Unlock()
 		if ok == false && IPNetContains(state.RoutingDeny, loc.IP) {
 			// Firewall deny
+			metricFirewallDenied.WithLabelValues("tcp").Inc()
 			r.Complete(true)
 			return
 		}
 		if ok == false && IPNetContains(state.RoutingAllow, loc.IP) == false {
 			// Firewall !allow
+			metricFirewallDenied.WithLabelValues("tcp").Inc()
 			r.Complete(true)
 			return
 		}
@@ -77,6 +108,7 @@ func TcpRoutingHandler(state *State) func(*tcp.ForwarderRequest) {
 		ep, errx := r.CreateEndpoint(&wq)
 		if errx != nil {
 			fmt.Printf("r.CreateEndpoint() = %v\n", errx)
+			metricEndpointErrors.WithLabelValues("tcp").Inc()
 			return
 		}
 		ep.SetSockOptInt(tcpip.DelayOption, 0)
@@ -84,24 +116,35 @@ func TcpRoutingHandler(state *State) func(*tcp.ForwarderRequest) {
 		xconn := gonet.NewConn(&wq, ep)
 		conn := &GonetTCPConn{xconn, ep}
 
+		state.wg.Add(1)
 		go func() {
 			if rf != nil {
-				RemoteForward(conn, rf)
+				RemoteForward(state, conn, rf)
 			} else {
-				RoutingForward(conn, loc)
+				RoutingForward(state, conn, loc)
 			}
 		}()
 	}
 	return h
 }
 
-func RoutingForward(guest KaConn, loc net.Addr) {
+// RoutingForward expects state.wg.Add(1) to already have been called by
+// the caller before it was spawned, so Wait() can't race a connection
+// that's been accepted but whose goroutine hasn't run yet.
+func RoutingForward(state *State, guest KaConn, loc net.Addr) {
+	defer state.wg.Done()
+
 	ga := guest.RemoteAddr()
+	proto := ga.Network()
 	fmt.Printf("[+] %s://%s/%s Routing conn new\n",
-		ga.Network(),
+		proto,
 		ga,
 		loc.String())
+	state.events.Emit(ConnEvent{Kind: "new", Proto: proto, Guest: ga.String(), Dest: loc.String()})
+	metricActiveConns.WithLabelValues(proto).Inc()
+	defer metricActiveConns.WithLabelValues(proto).Dec()
 
+	cc := &countingConn{KaConn: guest}
 	var pe ProxyError
 	xhost, err := net.Dial(loc.Network(), loc.String())
 	if err != nil {
@@ -117,24 +160,41 @@ func RoutingForward(guest KaConn, loc net.Addr) {
 		case *net.UDPConn:
 			host = &KaUDPConn{Conn: v}
 		}
-		pe = connSplice(guest, host)
+		pe = spliceWithCancel(state.ctx, cc, host)
 	}
+	metricBytesIn.WithLabelValues(proto).Add(float64(cc.in))
+	metricBytesOut.WithLabelValues(proto).Add(float64(cc.out))
 	fmt.Printf("[-] %s://%s/%s Routing conn done: %s\n",
-		ga.Network(),
+		proto,
 		ga,
 		loc.String(),
 		pe)
+	state.events.Emit(ConnEvent{
+		Kind: "close", Proto: proto, Guest: ga.String(), Dest: loc.String(),
+		BytesIn: cc.in, BytesOut: cc.out, Error: pe.String(),
+	})
 }
 
-func RemoteForward(guest KaConn, rf *FwdAddr) {
+// RemoteForward, like RoutingForward, expects the caller to have already
+// called state.wg.Add(1) before spawning it.
+func RemoteForward(state *State, guest KaConn, rf *FwdAddr) {
+	defer state.wg.Done()
+
 	ga := guest.RemoteAddr()
+	proto := ga.Network()
+	dest := rf.HostAddr().String()
 	fmt.Printf("[+] %s://%s/%s %s-remote-fwd conn new\n",
-		ga.Network(),
+		proto,
 		ga,
 		guest.LocalAddr(),
-		rf.HostAddr().String())
+		dest)
+	state.events.Emit(ConnEvent{Kind: "new", Proto: proto, Guest: ga.String(), Dest: dest})
+	metricActiveConns.WithLabelValues(proto).Inc()
+	defer metricActiveConns.WithLabelValues(proto).Dec()
+
+	cc := &countingConn{KaConn: guest}
 	var pe ProxyError
-	xhost, err := net.Dial(rf.network, rf.HostAddr().String())
+	xhost, err := net.Dial(rf.network, dest)
 	if err != nil {
 		SetResetOnClose(guest)
 		guest.Close()
@@ -148,12 +208,18 @@ func RemoteForward(guest KaConn, rf *FwdAddr) {
 		case *net.UDPConn:
 			host = &KaUDPConn{Conn: v}
 		}
-		pe = connSplice(guest, host)
+		pe = spliceWithCancel(state.remoteRuleContext(rf), cc, host)
 	}
+	metricBytesIn.WithLabelValues(proto).Add(float64(cc.in))
+	metricBytesOut.WithLabelValues(proto).Add(float64(cc.out))
 	fmt.Printf("[-] %s://%s/%s %s-remote-fwd conn done: %s\n",
-		ga.Network(),
+		proto,
 		ga,
 		guest.LocalAddr(),
-		rf.HostAddr().String(),
+		dest,
 		pe)
+	state.events.Emit(ConnEvent{
+		Kind: "close", Proto: proto, Guest: ga.String(), Dest: dest,
+		BytesIn: cc.in, BytesOut: cc.out, Error: pe.String(),
+	})
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+var shutdownTimeout time.Duration
+
+func init() {
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait for in-flight connections to drain on SIGINT/SIGTERM before forcing stack teardown")
+}
+
+// closeListeners closes every currently-open local-fwd listener, both
+// the ones opened from -L at startup and any still open from -config,
+// so a graceful shutdown stops accepting new guest connections
+// immediately.
+func closeListeners(state *State, startupListeners []Listener) {
+	for _, srv := range startupListeners {
+		srv.Close()
+	}
+	state.configMu.Lock()
+	for key, rule := range state.localRules {
+		rule.srv.Close()
+		delete(state.localRules, key)
+	}
+	state.configMu.Unlock()
+}
+
+// spliceWithCancel runs connSplice in the background and returns as
+// soon as either it finishes or ctx is canceled; in the latter case it
+// closes both ends first so connSplice unblocks instead of leaking.
+func spliceWithCancel(ctx context.Context, guest, host KaConn) ProxyError {
+	done := make(chan ProxyError, 1)
+	go func() { done <- connSplice(guest, host) }()
+	select {
+	case pe := <-done:
+		return pe
+	case <-ctx.Done():
+		guest.Close()
+		host.Close()
+		return <-done
+	}
+}